@@ -0,0 +1,325 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// Disposal is how a frame's canvas rectangle should be treated before the
+// next frame is composited, mirroring image/gif's disposal methods.
+type Disposal int
+
+const (
+	// DisposalNone leaves the frame's pixels on the canvas.
+	DisposalNone Disposal = iota
+	// DisposalBackground clears the frame's rectangle to the animation's
+	// background color before the next frame is drawn.
+	DisposalBackground
+)
+
+// AnimatedWebP holds the decoded frames of an animated WebP file, analogous
+// to image/gif's GIF struct.
+type AnimatedWebP struct {
+	// Image holds each frame, already composited onto the full canvas.
+	Image []image.Image
+	// Delay holds each frame's display duration, in milliseconds.
+	Delay []int
+	// Disposal holds each frame's disposal method.
+	Disposal []Disposal
+	// Blend reports, for each frame, whether it was alpha-blended onto
+	// the canvas (true) or drawn by overwriting it (false).
+	Blend []bool
+
+	// LoopCount is the number of times the animation should play; 0 means
+	// loop forever.
+	LoopCount int
+	// BackgroundColor is the canvas's initial and disposal-to color.
+	BackgroundColor image.Image
+
+	// Config describes the animation's canvas.
+	Config image.Config
+}
+
+// animHeader is the parsed ANIM chunk: background color and loop count.
+type animHeader struct {
+	background image.Image
+	loopCount  int
+}
+
+func readANIM(br *bufio.Reader, length uint32) (animHeader, error) {
+	if length < 6 {
+		return animHeader{}, errors.New("webp: invalid ANIM chunk")
+	}
+	var b [6]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return animHeader{}, err
+	}
+	if err := skipChunkPadding(br, length); err != nil {
+		return animHeader{}, err
+	}
+	bg := image.NewUniform(color.NRGBA{R: b[2], G: b[1], B: b[0], A: b[3]})
+	loopCount := int(b[4]) | int(b[5])<<8
+	return animHeader{background: bg, loopCount: loopCount}, nil
+}
+
+// anmfHeader is one ANMF chunk's frame rectangle, timing and compositing
+// flags, read before the frame's own image sub-chunks.
+type anmfHeader struct {
+	rect      image.Rectangle
+	delayMS   int
+	disposal  Disposal
+	blend     bool
+	chunkSize uint32 // bytes of frame data (sub-chunks) following the header
+}
+
+func readANMF(br *bufio.Reader, length uint32) (anmfHeader, error) {
+	if length < 16 {
+		return anmfHeader{}, errors.New("webp: invalid ANMF chunk")
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return anmfHeader{}, err
+	}
+	x := 2 * (int(b[0]) | int(b[1])<<8 | int(b[2])<<16)
+	y := 2 * (int(b[3]) | int(b[4])<<8 | int(b[5])<<16)
+	w := 1 + (int(b[6]) | int(b[7])<<8 | int(b[8])<<16)
+	h := 1 + (int(b[9]) | int(b[10])<<8 | int(b[11])<<16)
+	delay := int(b[12]) | int(b[13])<<8 | int(b[14])<<16
+	flags := b[15]
+
+	h2 := anmfHeader{
+		rect:      image.Rect(x, y, x+w, y+h),
+		delayMS:   delay,
+		disposal:  DisposalNone,
+		blend:     flags&0x02 == 0,
+		chunkSize: length - 16,
+	}
+	if flags&0x01 != 0 {
+		h2.disposal = DisposalBackground
+	}
+	return h2, nil
+}
+
+// DecodeAll decodes r, which must be an animated (VP8X+ANIM) WebP file,
+// into an AnimatedWebP holding every frame already composited onto the
+// animation's canvas.
+func DecodeAll(r io.Reader) (*AnimatedWebP, error) {
+	fr, err := NewFrameReader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &AnimatedWebP{
+		LoopCount:       fr.anim.loopCount,
+		BackgroundColor: fr.anim.background,
+		Config:          fr.config,
+	}
+	for {
+		frame, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		img := image.NewNRGBA(fr.canvas.Bounds())
+		draw.Draw(img, img.Bounds(), fr.canvas, image.Point{}, draw.Src)
+		a.Image = append(a.Image, img)
+		a.Delay = append(a.Delay, frame.delayMS)
+		a.Disposal = append(a.Disposal, frame.disposal)
+		a.Blend = append(a.Blend, frame.blend)
+	}
+	return a, nil
+}
+
+// Frame is a single decoded, canvas-positioned animation frame.
+type Frame struct {
+	delayMS  int
+	disposal Disposal
+	blend    bool
+}
+
+// FrameReader decodes one animation frame at a time, bounding memory use
+// for long animations. Each call to Next composites the next ANMF chunk
+// onto an internally held canvas; Canvas returns that canvas after each
+// call.
+type FrameReader struct {
+	br     *bufio.Reader
+	anim   animHeader
+	config image.Config
+	canvas draw.Image
+
+	prevRect     image.Rectangle
+	prevDisposal Disposal
+	havePrev     bool
+}
+
+// NewFrameReader reads r's VP8X and ANIM headers and returns a FrameReader
+// positioned at the first ANMF chunk.
+func NewFrameReader(r io.Reader) (*FrameReader, error) {
+	br := bufio.NewReader(r)
+	if _, err := readRIFFHeader(br); err != nil {
+		return nil, err
+	}
+	fourCC, length, err := readChunkHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if fourCC != "VP8X" {
+		return nil, errors.New("webp: not an animated WebP (missing VP8X chunk)")
+	}
+	if length < 10 {
+		return nil, errors.New("webp: invalid VP8X chunk")
+	}
+	var hdr [10]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if err := skipChunkPadding(br, length); err != nil {
+		return nil, err
+	}
+	features := readVP8XFeatures(hdr[0])
+	if !features.hasAnim {
+		return nil, errors.New("webp: not an animated WebP (ANIM flag not set)")
+	}
+	width := 1 + (int(hdr[4]) | int(hdr[5])<<8 | int(hdr[6])<<16)
+	height := 1 + (int(hdr[7]) | int(hdr[8])<<8 | int(hdr[9])<<16)
+	if err := validateCanvasDimensions(width, height); err != nil {
+		return nil, err
+	}
+
+	fr := &FrameReader{br: br}
+	fr.config = image.Config{ColorModel: color.NRGBAModel, Width: width, Height: height}
+
+	for {
+		fourCC, length, err := readChunkHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		switch fourCC {
+		case "ANIM":
+			anim, err := readANIM(br, length)
+			if err != nil {
+				return nil, err
+			}
+			fr.anim = anim
+			canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+			draw.Draw(canvas, canvas.Bounds(), anim.background, image.Point{}, draw.Src)
+			fr.canvas = canvas
+			return fr, nil
+		case "ICCP", "EXIF", "XMP ":
+			if _, err := br.Discard(int(length)); err != nil {
+				return nil, err
+			}
+			if err := skipChunkPadding(br, length); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("webp: expected ANIM chunk after VP8X")
+		}
+	}
+}
+
+// Canvas returns the full animation canvas as it stood after the most
+// recent call to Next.
+func (fr *FrameReader) Canvas() image.Image {
+	return fr.canvas
+}
+
+// Next decodes and composites the next ANMF chunk onto the canvas,
+// returning io.EOF once the last frame has been read.
+func (fr *FrameReader) Next() (Frame, error) {
+	fourCC, length, err := readChunkHeader(fr.br)
+	if err == io.EOF {
+		return Frame{}, io.EOF
+	}
+	if err != nil {
+		return Frame{}, err
+	}
+	if fourCC != "ANMF" {
+		return Frame{}, errors.New("webp: expected ANMF chunk")
+	}
+	hdr, err := readANMF(fr.br, length)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	// The previous frame's disposal method governs the canvas state
+	// before this frame is drawn, not this frame's own.
+	if fr.havePrev && fr.prevDisposal == DisposalBackground {
+		draw.Draw(fr.canvas, fr.prevRect, fr.anim.background, image.Point{}, draw.Src)
+	}
+
+	sub := bufio.NewReader(io.LimitReader(fr.br, int64(hdr.chunkSize)))
+
+	var frameImg image.Image
+	var alpha []byte
+	for {
+		subFourCC, subLen, err := readChunkHeader(sub)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		switch subFourCC {
+		case "ALPH":
+			lr := &io.LimitedReader{R: sub, N: int64(subLen)}
+			a, err := decodeALPH(lr, hdr.rect.Dx(), hdr.rect.Dy())
+			if err != nil {
+				return Frame{}, err
+			}
+			if lr.N > 0 {
+				if _, err := io.CopyN(io.Discard, lr.R, lr.N); err != nil {
+					return Frame{}, err
+				}
+			}
+			alpha = a
+		case "VP8 ":
+			m, err := readBoundedChunk(sub, subLen, decodeVP8)
+			if err != nil {
+				return Frame{}, err
+			}
+			frameImg = m
+		case "VP8L":
+			m, err := readBoundedChunk(sub, subLen, decodeVP8L)
+			if err != nil {
+				return Frame{}, err
+			}
+			frameImg = m
+		default:
+			if _, err := sub.Discard(int(subLen)); err != nil {
+				return Frame{}, err
+			}
+		}
+		if err := skipChunkPadding(sub, subLen); err != nil {
+			return Frame{}, err
+		}
+	}
+	if err := skipChunkPadding(fr.br, length); err != nil {
+		return Frame{}, err
+	}
+	if frameImg == nil {
+		return Frame{}, errors.New("webp: ANMF chunk has no image data")
+	}
+	if yc, ok := frameImg.(*image.YCbCr); ok && alpha != nil {
+		frameImg = combineYCbCrAlpha(yc, alpha)
+	}
+
+	op := draw.Over
+	if !hdr.blend {
+		op = draw.Src
+	}
+	draw.Draw(fr.canvas, hdr.rect, frameImg, frameImg.Bounds().Min, op)
+
+	fr.prevRect, fr.prevDisposal, fr.havePrev = hdr.rect, hdr.disposal, true
+
+	return Frame{delayMS: hdr.delayMS, disposal: hdr.disposal, blend: hdr.blend}, nil
+}
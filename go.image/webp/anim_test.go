@@ -0,0 +1,140 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"testing"
+)
+
+// buildAnimated assembles a minimal animated (VP8X+ANIM) WebP file from a
+// sequence of VP8L-encoded frames, each drawn at the canvas's origin. There's
+// no lossy-frame case since decodeVP8 doesn't support lossy bitstreams yet.
+func buildAnimated(t *testing.T, width, height int, frames []image.Image, delaysMS []int) []byte {
+	t.Helper()
+
+	var vp8x bytes.Buffer
+	vp8x.WriteByte(1 << 1) // ANIM flag
+	vp8x.Write([]byte{0, 0, 0})
+	writeDim(&vp8x, width)
+	writeDim(&vp8x, height)
+
+	var anim bytes.Buffer
+	anim.Write([]byte{0, 0, 0, 0}) // background color, BGRA
+	anim.WriteByte(0)              // loop count, low byte
+	anim.WriteByte(0)              // loop count, high byte
+
+	var body bytes.Buffer
+	writeRIFFChunk(&body, "VP8X", vp8x.Bytes())
+	writeRIFFChunk(&body, "ANIM", anim.Bytes())
+
+	for i, frame := range frames {
+		payload, _, err := encodeVP8L(frame, &Options{})
+		if err != nil {
+			t.Fatalf("frame %d: encodeVP8L: %v", i, err)
+		}
+		if len(payload)%2 != 0 {
+			payload = append(payload, 0)
+		}
+		var sub bytes.Buffer
+		writeRIFFChunk(&sub, "VP8L", payload)
+
+		b := frame.Bounds()
+		var anmf bytes.Buffer
+		writeDim24(&anmf, 0) // X offset / 2
+		writeDim24(&anmf, 0) // Y offset / 2
+		writeDim(&anmf, b.Dx())
+		writeDim(&anmf, b.Dy())
+		writeDim24(&anmf, delaysMS[i])
+		anmf.WriteByte(0) // blend=Over, disposal=none
+		anmf.Write(sub.Bytes())
+
+		writeRIFFChunk(&body, "ANMF", anmf.Bytes())
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	writeLE32(&out, uint32(4+body.Len()))
+	out.WriteString("WEBP")
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func writeDim24(buf *bytes.Buffer, n int) {
+	v := uint32(n)
+	buf.WriteByte(byte(v))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v >> 16))
+}
+
+func animTestFrames() []image.Image {
+	f0 := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	f1 := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			f0.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 10), G: 0, B: uint8(y * 20), A: 255})
+			f1.SetNRGBA(x, y, color.NRGBA{R: 0, G: uint8(x * 10), B: uint8(y * 20), A: 255})
+		}
+	}
+	return []image.Image{f0, f1}
+}
+
+func TestDecodeAll(t *testing.T) {
+	frames := animTestFrames()
+	data := buildAnimated(t, 4, 3, frames, []int{100, 150})
+
+	a, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(a.Image) != len(frames) {
+		t.Fatalf("DecodeAll: got %d frames, want %d", len(a.Image), len(frames))
+	}
+	if len(a.Image) != len(a.Delay) || len(a.Image) != len(a.Disposal) || len(a.Image) != len(a.Blend) {
+		t.Fatalf("DecodeAll: mismatched per-frame slice lengths")
+	}
+	wantDelays := []int{100, 150}
+	for i, d := range a.Delay {
+		if d != wantDelays[i] {
+			t.Errorf("frame %d: delay: got %d, want %d", i, d, wantDelays[i])
+		}
+	}
+	for i, frame := range frames {
+		want := toNRGBA(frame)
+		got, ok := a.Image[i].(*image.NRGBA)
+		if !ok {
+			t.Errorf("frame %d: image is %T, want *image.NRGBA", i, a.Image[i])
+			continue
+		}
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("frame %d: decoded pixels do not match the source frame", i)
+		}
+	}
+}
+
+func TestNewFrameReaderStreaming(t *testing.T) {
+	frames := animTestFrames()
+	data := buildAnimated(t, 4, 3, frames, []int{100, 150})
+
+	fr, err := NewFrameReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewFrameReader: %v", err)
+	}
+	n := 0
+	for {
+		if _, err := fr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		n++
+	}
+	if n != len(frames) {
+		t.Fatalf("NewFrameReader: read %d frames, want %d", n, len(frames))
+	}
+}
@@ -0,0 +1,877 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Transform identifies one of the lossless (VP8L) pre-processing transforms
+// that Encode may apply before entropy coding the pixel stream.
+type Transform int
+
+const (
+	// TransformSubtractGreen replaces the red and blue channels with
+	// (red-green) and (blue-green) mod 256, which decorrelates the
+	// channels of most natural and synthetic images.
+	TransformSubtractGreen Transform = iota
+	// TransformPredictor predicts each pixel from its neighbors and stores
+	// only the residual.
+	TransformPredictor
+	// TransformColor applies a per-tile linear transform that predicts red
+	// and blue from green (and blue from red), which further decorrelates
+	// the channels on top of TransformSubtractGreen.
+	TransformColor
+	// TransformColorIndexing replaces each pixel with an index into a
+	// palette of at most 256 distinct colors. It is only attempted when
+	// the source image actually has few enough distinct colors.
+	TransformColorIndexing
+)
+
+// Options are the encoding parameters. A nil *Options is equivalent to the
+// zero value, which lets Encode choose the transforms and color cache size.
+type Options struct {
+	// Transforms restricts the set of transforms Encode is allowed to try,
+	// in the order they should be applied. A nil slice lets Encode pick a
+	// reasonable default (subtract-green, falling back to color-indexing
+	// for low color-count images).
+	Transforms []Transform
+
+	// ColorCacheBits is the log2 of the number of entries in the color
+	// cache used by the LZ77 back-reference coder. It must be in the
+	// range [0, 11]; 0 disables the color cache.
+	ColorCacheBits int
+
+	// Exact preserves the RGB values of fully transparent pixels. By
+	// default, Encode is free to set them to whatever value compresses
+	// best, matching how most decoders (and this package's Decode) treat
+	// them as don't-care.
+	Exact bool
+}
+
+// Encode writes the Image m to w in the WebP format.
+//
+// As of this implementation, only lossless (VP8L) encoding is supported; m
+// is always written as a lossless WebP image, regardless of its own pixel
+// format.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+	b := m.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > 1<<14 || b.Dy() > 1<<14 {
+		return errors.New("webp: invalid image size for encoding")
+	}
+
+	payload, _, err := encodeVP8L(m, o)
+	if err != nil {
+		return err
+	}
+	if len(payload)%2 != 0 {
+		payload = append(payload, 0)
+	}
+
+	bw := bufio.NewWriter(w)
+	riffLen := uint32(4 + 8 + len(payload)) // "WEBP" + chunk header + chunk data
+	writeFourCC(bw, "RIFF")
+	writeUint32LE(bw, riffLen)
+	writeFourCC(bw, "WEBP")
+	writeFourCC(bw, "VP8L")
+	writeUint32LE(bw, uint32(len(payload)))
+	bw.Write(payload)
+	return bw.Flush()
+}
+
+// encoderRegistry lets code that writes images in several formats look up
+// this package's Encode by name, the write-side counterpart to how
+// image.RegisterFormat lets image.Decode sniff and read by name.
+var encoderRegistry = map[string]func(io.Writer, image.Image, *Options) error{}
+
+func init() {
+	RegisterEncoder("webp", Encode)
+}
+
+// RegisterEncoder records enc under name, so EncoderByName can later look
+// it up.
+func RegisterEncoder(name string, enc func(io.Writer, image.Image, *Options) error) {
+	encoderRegistry[name] = enc
+}
+
+// EncoderByName returns the encoder registered under name, or nil if none
+// was registered.
+func EncoderByName(name string) func(io.Writer, image.Image, *Options) error {
+	return encoderRegistry[name]
+}
+
+func writeFourCC(w *bufio.Writer, s string) {
+	w.WriteString(s)
+}
+
+func writeUint32LE(w *bufio.Writer, v uint32) {
+	w.WriteByte(byte(v))
+	w.WriteByte(byte(v >> 8))
+	w.WriteByte(byte(v >> 16))
+	w.WriteByte(byte(v >> 24))
+}
+
+// encodeVP8L returns the VP8L chunk payload (everything after the "VP8L"
+// fourCC and its length) for m, along with whether the pixel stream uses a
+// non-opaque alpha channel.
+func encodeVP8L(m image.Image, o *Options) (payload []byte, alphaUsed bool, err error) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	pix, alphaUsed := toARGB(m, o.Exact)
+
+	bw := newBitWriter()
+	bw.writeBits(0x2f, 8) // VP8L signature
+	bw.writeBits(uint32(w-1), 14)
+	bw.writeBits(uint32(h-1), 14)
+	if alphaUsed {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // version
+
+	transforms := o.Transforms
+	if transforms == nil {
+		transforms = chooseDefaultTransforms(pix)
+	}
+
+	for _, t := range transforms {
+		switch t {
+		case TransformSubtractGreen:
+			bw.writeBits(1, 1)
+			bw.writeBits(2, 2) // transform type 2: subtract-green
+			subtractGreenTransform(pix)
+		case TransformColorIndexing:
+			pal := buildPalette(pix)
+			if pal == nil {
+				continue
+			}
+			bw.writeBits(1, 1)
+			bw.writeBits(3, 2) // transform type 3: color-indexing
+			bw.writeBits(uint32(len(pal)-1), 8)
+			writePalette(bw, pal)
+			pix = applyColorIndexing(pix, pal)
+		case TransformPredictor:
+			bw.writeBits(1, 1)
+			bw.writeBits(0, 2) // transform type 0: predictor
+			// A single full-image block using predictor mode 1 ("use
+			// the pixel to the left"), the simplest predictor that
+			// still helps on most images.
+			bits := blockBitsForSize(w, h)
+			bw.writeBits(uint32(bits), 3)
+			predictorTransform(pix, w, h)
+			// The 1x1 sub-resolution predictor-mode image: green
+			// channel holds the mode, as if it went through the
+			// same ARGB encoder recursively.
+			writeTransformParamImage(bw, []uint32{0x00000100}, 1, o)
+		case TransformColor:
+			bw.writeBits(1, 1)
+			bw.writeBits(1, 2) // transform type 1: color transform
+			bits := blockBitsForSize(w, h)
+			bw.writeBits(uint32(bits), 3)
+			blockSize := 1 << uint(bits+2)
+			tw := (w + blockSize - 1) / blockSize
+			th := (h + blockSize - 1) / blockSize
+			tiles := make([]uint32, tw*th)
+			colorTransformForward(pix, w, h, tiles, tw, blockSize)
+			// The sub-resolution color-transform tile image: the three
+			// signed multipliers packed into the red/green/blue
+			// channels, as if it went through the same ARGB encoder
+			// recursively.
+			writeTransformParamImage(bw, tiles, tw, o)
+		}
+	}
+	bw.writeBits(0, 1) // no more transforms
+
+	cacheBits := o.ColorCacheBits
+	if cacheBits < 0 || cacheBits > 11 {
+		cacheBits = 0
+	}
+	if cacheBits > 0 {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(cacheBits), 4)
+	} else {
+		bw.writeBits(0, 1)
+	}
+
+	bw.writeBits(0, 1) // no meta Huffman image: a single Huffman code group
+
+	writeImageData(bw, pix, cacheBits, w)
+
+	return bw.bytes(), alphaUsed, nil
+}
+
+func blockBitsForSize(w, h int) int {
+	n := w
+	if h > n {
+		n = h
+	}
+	bits := 0
+	for 1<<uint(bits) < n {
+		bits++
+	}
+	return bits
+}
+
+func chooseDefaultTransforms(pix []uint32) []Transform {
+	if pal := buildPalette(pix); pal != nil {
+		return []Transform{TransformColorIndexing}
+	}
+	return []Transform{TransformSubtractGreen}
+}
+
+// toARGB flattens m into a slice of packed 0xAARRGGBB pixels, row-major,
+// matching the order the lossless bitstream expects.
+func toARGB(m image.Image, exact bool) (pix []uint32, alphaUsed bool) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	pix = make([]uint32, w*h)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// Image.At's RGBA() is alpha-premultiplied, but the VP8L
+			// bitstream stores straight color; convert through NRGBA
+			// to undo the premultiplication before packing.
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			r8, g8, b8, a8 := uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+			if a8 != 255 {
+				alphaUsed = true
+			}
+			if a8 == 0 && !exact {
+				r8, g8, b8 = 0, 0, 0
+			}
+			pix[i] = a8<<24 | r8<<16 | g8<<8 | b8
+			i++
+		}
+	}
+	return pix, alphaUsed
+}
+
+func subtractGreenTransform(pix []uint32) {
+	for i, p := range pix {
+		a := p >> 24
+		r := (p >> 16) & 0xff
+		g := (p >> 8) & 0xff
+		b := p & 0xff
+		r = (r - g) & 0xff
+		b = (b - g) & 0xff
+		pix[i] = a<<24 | r<<16 | g<<8 | b
+	}
+}
+
+// colorTransformForward computes, for each tile, the green_to_red,
+// green_to_blue and red_to_blue multipliers that invColorTransform will
+// later invert, and applies them to pix. Each multiplier is fit by a
+// least-squares estimate over its tile (predicting red and blue from
+// green, then the remaining blue residual from the now-transformed red),
+// mirroring invColorTransform's exact order of operations so the two
+// invert each other.
+func colorTransformForward(pix []uint32, w, h int, tiles []uint32, tw, blockSize int) {
+	th := len(tiles) / tw
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			x0, y0 := tx*blockSize, ty*blockSize
+			x1, y1 := x0+blockSize, y0+blockSize
+			if x1 > w {
+				x1 = w
+			}
+			if y1 > h {
+				y1 = h
+			}
+
+			var sumGR, sumGB, sumGG int64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := pix[y*w+x]
+					r := int64(int8(p >> 16))
+					g := int64(int8(p >> 8))
+					b := int64(int8(p))
+					sumGR += g * r
+					sumGB += g * b
+					sumGG += g * g
+				}
+			}
+			g2r := fitColorCoeff(sumGR, sumGG)
+			g2b := fitColorCoeff(sumGB, sumGG)
+
+			var sumRB, sumRR int64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := pix[y*w+x]
+					r := uint8(p >> 16)
+					g := uint8(p >> 8)
+					b := uint8(p)
+					newR := r - colorTransformDelta(g2r, g)
+					residB := b - colorTransformDelta(g2b, g)
+					sumRB += int64(int8(newR)) * int64(int8(residB))
+					sumRR += int64(int8(newR)) * int64(int8(newR))
+				}
+			}
+			r2b := fitColorCoeff(sumRB, sumRR)
+
+			tiles[ty*tw+tx] = 0xff000000 | uint32(g2r)<<16 | uint32(g2b)<<8 | uint32(r2b)
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := y*w + x
+					p := pix[i]
+					a := p >> 24
+					r := uint8(p >> 16)
+					g := uint8(p >> 8)
+					b := uint8(p)
+					newR := r - colorTransformDelta(g2r, g)
+					newB := b - colorTransformDelta(r2b, newR) - colorTransformDelta(g2b, g)
+					pix[i] = a<<24 | uint32(newR)<<16 | uint32(g)<<8 | uint32(newB)
+				}
+			}
+		}
+	}
+}
+
+// fitColorCoeff returns the int8 multiplier m (packed as uint8) minimizing
+// the squared error of predicting y from x via colorTransformDelta's
+// (m*x)>>5 model, given the cross- and auto-correlation sums of a tile's
+// signed channel values.
+func fitColorCoeff(sumXY, sumXX int64) uint8 {
+	if sumXX == 0 {
+		return 0
+	}
+	m := (sumXY << 5) / sumXX
+	if m > 127 {
+		m = 127
+	} else if m < -128 {
+		m = -128
+	}
+	return uint8(int8(m))
+}
+
+func predictorTransform(pix []uint32, w, h int) {
+	// Predictor mode 1: predict from the pixel immediately to the left,
+	// storing only the wraparound difference. The first pixel of each
+	// row is instead predicted from the pixel above it, except the very
+	// first pixel of the image, predicted from opaque black, per the spec.
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			i := y*w + x
+			var pred uint32 = 0xff000000
+			if x > 0 {
+				pred = pix[i-1]
+			} else if y > 0 {
+				pred = pix[i-w]
+			}
+			pix[i] = subARGB(pix[i], pred)
+		}
+	}
+}
+
+func subARGB(p, pred uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := (p >> shift) & 0xff
+		pv := (pred >> shift) & 0xff
+		out |= ((v - pv) & 0xff) << shift
+	}
+	return out
+}
+
+func buildPalette(pix []uint32) []uint32 {
+	seen := make(map[uint32]bool, 256)
+	var pal []uint32
+	for _, p := range pix {
+		if seen[p] {
+			continue
+		}
+		if len(pal) == 256 {
+			return nil
+		}
+		seen[p] = true
+		pal = append(pal, p)
+	}
+	return pal
+}
+
+func writePalette(bw *bitWriter, pal []uint32) {
+	prev := uint32(0)
+	img := make([]uint32, len(pal))
+	for i, p := range pal {
+		img[i] = subARGB(p, prev)
+		prev = p
+	}
+	writeTransformParamImage(bw, img, len(pal), &Options{})
+}
+
+func applyColorIndexing(pix []uint32, pal []uint32) []uint32 {
+	idx := make(map[uint32]uint32, len(pal))
+	for i, p := range pal {
+		idx[p] = uint32(i)
+	}
+	out := make([]uint32, len(pix))
+	for i, p := range pix {
+		out[i] = 0xff000000 | idx[p]<<8
+	}
+	return out
+}
+
+// writeTransformParamImage encodes a small auxiliary image (a palette or a
+// predictor/color-transform parameter block) using the same ARGB image
+// coder as the main pixel stream, but with no further transforms or color
+// cache of its own.
+func writeTransformParamImage(bw *bitWriter, pix []uint32, width int, o *Options) {
+	writeImageData(bw, pix, 0, width)
+}
+
+// writeImageData entropy-codes pix (an ARGB pixel stream, row-major) as a
+// single Huffman-coded, LZ77 + color-cache back-referenced image, per the
+// VP8L spec.
+func writeImageData(bw *bitWriter, pix []uint32, cacheBits, width int) {
+	tokens, cacheSize := tokenizeLZ77(pix, cacheBits)
+
+	greenLenAlphabet := 256 + 24 + cacheSize
+	greenLenHist := make([]int, greenLenAlphabet)
+	redHist := make([]int, 256)
+	blueHist := make([]int, 256)
+	alphaHist := make([]int, 256)
+	distHist := make([]int, 40)
+
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			greenLenHist[(t.argb>>8)&0xff]++
+			redHist[(t.argb>>16)&0xff]++
+			blueHist[t.argb&0xff]++
+			alphaHist[t.argb>>24]++
+		case tokenCache:
+			greenLenHist[256+24+t.cacheIdx]++
+		case tokenCopy:
+			greenLenHist[256+lengthCode(t.length)]++
+			distHist[distanceCode(t.distance, width)]++
+		}
+	}
+
+	greenLenCode := buildHuffmanCode(greenLenHist)
+	redCode := buildHuffmanCode(redHist)
+	blueCode := buildHuffmanCode(blueHist)
+	alphaCode := buildHuffmanCode(alphaHist)
+	distCode := buildHuffmanCode(distHist)
+
+	writeHuffmanCodeLengths(bw, greenLenCode.lengths)
+	writeHuffmanCodeLengths(bw, redCode.lengths)
+	writeHuffmanCodeLengths(bw, blueCode.lengths)
+	writeHuffmanCodeLengths(bw, alphaCode.lengths)
+	writeHuffmanCodeLengths(bw, distCode.lengths)
+
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			greenLenCode.write(bw, int((t.argb>>8)&0xff))
+			redCode.write(bw, int((t.argb>>16)&0xff))
+			blueCode.write(bw, int(t.argb&0xff))
+			alphaCode.write(bw, int(t.argb>>24))
+		case tokenCache:
+			greenLenCode.write(bw, 256+24+t.cacheIdx)
+		case tokenCopy:
+			lc, lBits, lVal := lengthCodeAndExtra(t.length)
+			greenLenCode.write(bw, 256+lc)
+			bw.writeBits(lVal, lBits)
+			dc, dBits, dVal := distanceCodeAndExtra(t.distance, width)
+			distCode.write(bw, dc)
+			bw.writeBits(dVal, dBits)
+		}
+	}
+}
+
+type tokenKind int
+
+const (
+	tokenLiteral tokenKind = iota
+	tokenCopy
+	tokenCache
+)
+
+type lzToken struct {
+	kind     tokenKind
+	argb     uint32
+	length   int
+	distance int
+	cacheIdx int
+}
+
+const minMatchLength = 3
+
+// tokenizeLZ77 finds back-references in pix using a simple hash-chain
+// matcher, falling back to color-cache hits and plain literals. It mirrors
+// the decoder's token stream: LZ77 copies address pixel positions (not raw
+// bytes), and distances are coded relative to the current pixel.
+func tokenizeLZ77(pix []uint32, cacheBits int) (tokens []lzToken, cacheSize int) {
+	cacheSize = 0
+	var cache []uint32
+	if cacheBits > 0 {
+		cacheSize = 1 << uint(cacheBits)
+		cache = make([]uint32, cacheSize)
+	}
+	cacheIndex := func(p uint32) int {
+		return int((p * 0x1e35a7bd) >> uint(32-cacheBits))
+	}
+
+	const hashBits = 16
+	hashHead := make(map[uint32]int)
+	hashOf := func(i int) uint32 {
+		return (pix[i]*0x9e3779b1 ^ pix[i+1]*0x85ebca6b ^ pix[i+2]*0xc2b2ae35) >> (32 - hashBits)
+	}
+
+	i := 0
+	n := len(pix)
+	for i < n {
+		matchLen, matchDist := 0, 0
+		if i+minMatchLength <= n {
+			h := hashOf(i)
+			if j, ok := hashHead[h]; ok && j < i {
+				l := 0
+				maxLen := n - i
+				if maxLen > 4096 {
+					maxLen = 4096
+				}
+				for l < maxLen && pix[j+l] == pix[i+l] {
+					l++
+				}
+				if l >= minMatchLength {
+					matchLen, matchDist = l, i-j
+				}
+			}
+			hashHead[h] = i
+		}
+		if matchLen >= minMatchLength {
+			tokens = append(tokens, lzToken{kind: tokenCopy, length: matchLen, distance: matchDist})
+			end := i + matchLen
+			for ; i < end; i++ {
+				if i+minMatchLength <= n {
+					hashHead[hashOf(i)] = i
+				}
+				if cache != nil {
+					cache[cacheIndex(pix[i])] = pix[i]
+				}
+			}
+			continue
+		}
+		p := pix[i]
+		if cache != nil {
+			idx := cacheIndex(p)
+			if cache[idx] == p {
+				tokens = append(tokens, lzToken{kind: tokenCache, cacheIdx: idx})
+				i++
+				continue
+			}
+			cache[idx] = p
+		}
+		tokens = append(tokens, lzToken{kind: tokenLiteral, argb: p})
+		i++
+	}
+	return tokens, cacheSize
+}
+
+// The length and distance code tables below follow the VP8L spec: codes
+// 0-3 map 1:1 to small lengths/distances, and higher codes use a
+// power-of-two range with extra bits for the offset within that range.
+// Distance additionally goes through a "plane code" remapping (see
+// lzdistance.go) before reaching this range coding, so that small,
+// direction-ful offsets (e.g. one row up) code more cheaply than their raw
+// magnitude would suggest.
+
+func lengthCode(length int) int { c, _, _ := lengthCodeAndExtra(length); return c }
+func distanceCode(distance, width int) int {
+	c, _, _ := distanceCodeAndExtra(distance, width)
+	return c
+}
+
+func lengthCodeAndExtra(length int) (code int, bits uint, extra uint32) {
+	return rangeCodeAndExtra(length - 1)
+}
+
+func distanceCodeAndExtra(distance, width int) (code int, bits uint, extra uint32) {
+	planeCode := distanceToPlaneCode(width, distance)
+	return rangeCodeAndExtra(planeCode - 1)
+}
+
+// rangeCodeAndExtra encodes a non-negative integer v as one of the 40
+// standard DEFLATE-style length/distance codes used by VP8L for both the
+// copy length and the back-reference distance alphabets.
+func rangeCodeAndExtra(v int) (code int, bits uint, extra uint32) {
+	if v < 4 {
+		return v, 0, 0
+	}
+	nbits := 0
+	for (v + 1) >= (2 << uint(nbits)) {
+		nbits++
+	}
+	nbits--
+	base := (1 << uint(nbits+1))
+	code = 2*nbits + 2
+	if v < base+(1<<uint(nbits)) {
+		return code, uint(nbits), uint32(v - base)
+	}
+	return code + 1, uint(nbits), uint32(v - base - (1 << uint(nbits)))
+}
+
+// --- Huffman code construction -------------------------------------------
+
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (hc *huffmanCode) write(bw *bitWriter, symbol int) {
+	bw.writeBitsMSBFirst(hc.codes[symbol], uint(hc.lengths[symbol]))
+}
+
+// buildHuffmanCode builds a canonical Huffman code for the given symbol
+// frequency histogram, length-limited to 15 bits.
+func buildHuffmanCode(hist []int) *huffmanCode {
+	type node struct {
+		freq        int
+		left, right int // indices into nodes, or -1
+		symbol      int // -1 for internal nodes
+	}
+	var nodes []node
+	for sym, f := range hist {
+		if f > 0 {
+			nodes = append(nodes, node{freq: f, left: -1, right: -1, symbol: sym})
+		}
+	}
+	lengths := make([]uint8, len(hist))
+	if len(nodes) == 0 {
+		return &huffmanCode{lengths: lengths, codes: make([]uint32, len(hist))}
+	}
+	if len(nodes) == 1 {
+		lengths[nodes[0].symbol] = 1
+		return finishHuffman(lengths)
+	}
+
+	active := make([]int, len(nodes))
+	for i := range nodes {
+		active[i] = i
+	}
+	for len(active) > 1 {
+		// Find and remove the two lowest-frequency active nodes
+		// (a simple O(n^2) selection is fine for the small alphabets
+		// involved here).
+		bi, bj := 0, 1
+		if nodes[active[bj]].freq < nodes[active[bi]].freq {
+			bi, bj = bj, bi
+		}
+		for k := 2; k < len(active); k++ {
+			f := nodes[active[k]].freq
+			if f < nodes[active[bi]].freq {
+				bi, bj = k, bi
+			} else if f < nodes[active[bj]].freq {
+				bj = k
+			}
+		}
+		i, j := active[bi], active[bj]
+		nodes = append(nodes, node{freq: nodes[i].freq + nodes[j].freq, left: i, right: j, symbol: -1})
+		newIdx := len(nodes) - 1
+		if bi > bj {
+			bi, bj = bj, bi
+		}
+		active[bi] = newIdx
+		active = append(active[:bj], active[bj+1:]...)
+	}
+
+	var assign func(i int, depth uint8)
+	assign = func(i int, depth uint8) {
+		n := nodes[i]
+		if n.symbol >= 0 {
+			d := depth
+			if d == 0 {
+				d = 1
+			}
+			lengths[n.symbol] = d
+			return
+		}
+		assign(n.left, depth+1)
+		assign(n.right, depth+1)
+	}
+	assign(active[0], 0)
+	return finishHuffman(lengths)
+}
+
+// maxHuffmanCodeLength is the longest code VP8L's Huffman reader
+// (huffmanTree.read) accepts.
+const maxHuffmanCodeLength = 15
+
+// finishHuffman assigns canonical codes given code lengths, per RFC 1951
+// section 3.2.2. buildHuffmanCode's two-smallest-merge tree has no depth
+// limit, so a sufficiently skewed histogram (e.g. Fibonacci-like symbol
+// counts) can legally produce a code longer than maxHuffmanCodeLength; in
+// that case lengths are replaced with a flat, equal-length code instead,
+// which always satisfies the Kraft inequality within the bit budget VP8L
+// allows.
+func finishHuffman(lengths []uint8) *huffmanCode {
+	var maxLen uint8
+	for _, l := range lengths {
+		if l > maxLen {
+			maxLen = l
+		}
+	}
+	if maxLen > maxHuffmanCodeLength {
+		lengths = flattenHuffmanLengths(lengths)
+		maxLen = 0
+		for _, l := range lengths {
+			if l > maxLen {
+				maxLen = l
+			}
+		}
+	}
+	blCount := make([]int, maxLen+1)
+	for _, l := range lengths {
+		if l > 0 {
+			blCount[l]++
+		}
+	}
+	code := 0
+	nextCode := make([]int, maxLen+1)
+	for bits := uint8(1); bits <= maxLen; bits++ {
+		code = (code + blCount[bits-1]) << 1
+		nextCode[bits] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[sym] = uint32(nextCode[l])
+		nextCode[l]++
+	}
+	return &huffmanCode{lengths: lengths, codes: codes}
+}
+
+// flattenHuffmanLengths assigns every symbol with a nonzero length the same
+// length, chosen as the smallest power-of-two-implying bit count that fits
+// the number of active symbols. It trades away the unbalanced tree's
+// compression for a code that is guaranteed short enough for VP8L's reader
+// to accept, regardless of how skewed the source histogram was.
+func flattenHuffmanLengths(lengths []uint8) []uint8 {
+	n := 0
+	for _, l := range lengths {
+		if l > 0 {
+			n++
+		}
+	}
+	flat := make([]uint8, len(lengths))
+	if n == 0 {
+		return flat
+	}
+	bits := uint8(1)
+	for 1<<bits < n {
+		bits++
+	}
+	for i, l := range lengths {
+		if l > 0 {
+			flat[i] = bits
+		}
+	}
+	return flat
+}
+
+// writeHuffmanCodeLengths writes a Huffman code's length array using the
+// VP8L "normal" code-length-code encoding: the 19-symbol alphabet of code
+// length values, itself Huffman coded.
+func writeHuffmanCodeLengths(bw *bitWriter, lengths []uint8) {
+	nonZero := 0
+	var only int = -1
+	for sym, l := range lengths {
+		if l > 0 {
+			nonZero++
+			only = sym
+		}
+	}
+	if nonZero <= 1 {
+		bw.writeBits(1, 1) // simple code length code
+		if nonZero == 0 {
+			only = 0
+		}
+		if only < 1<<8 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(only), 8)
+		}
+		return
+	}
+	bw.writeBits(0, 1) // normal code length code
+
+	clHist := make([]int, 19)
+	for _, l := range lengths {
+		clHist[l]++
+	}
+	clCode := buildHuffmanCode(clHist)
+
+	order := [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	numCodes := 4
+	for i := 18; i >= 4; i-- {
+		if clCode.lengths[order[i]] != 0 {
+			numCodes = i + 1
+			break
+		}
+	}
+	bw.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		bw.writeBits(uint32(clCode.lengths[order[i]]), 3)
+	}
+	bw.writeBits(0, 1) // max_symbol not used: encode every length below
+
+	for _, l := range lengths {
+		clCode.write(bw, int(l))
+	}
+}
+
+// --- bit writer ------------------------------------------------------------
+
+// bitWriter packs bits LSB-first within each byte, matching the VP8L
+// bitstream's bit order.
+type bitWriter struct {
+	buf    []byte
+	bitBuf uint64
+	nBits  uint
+}
+
+func newBitWriter() *bitWriter {
+	return &bitWriter{}
+}
+
+// writeBits appends the low n bits of v, least-significant bit first.
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.bitBuf |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bitBuf))
+		w.bitBuf >>= 8
+		w.nBits -= 8
+	}
+}
+
+// writeBitsMSBFirst appends a Huffman code, whose bits are conventionally
+// listed most-significant first, by reversing it into the LSB-first stream.
+func (w *bitWriter) writeBitsMSBFirst(code uint32, n uint) {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		v = (v << 1) | ((code >> i) & 1)
+	}
+	w.writeBits(v, n)
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bitBuf))
+		w.bitBuf = 0
+		w.nBits = 0
+	}
+	return w.buf
+}
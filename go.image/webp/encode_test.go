@@ -0,0 +1,169 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEncodeDecodeRoundTrip encodes each testdata/*.png as a lossless WebP
+// and checks that decoding it again reproduces the original pixels exactly.
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	names, err := filepath.Glob("../testdata/*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Skip("no testdata/*.png files found")
+	}
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Errorf("%s: Open: %v", name, err)
+			continue
+		}
+		src, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: png.Decode: %v", name, err)
+			continue
+		}
+
+		want := toNRGBA(src)
+
+		var buf bytes.Buffer
+		if err := Encode(&buf, want, nil); err != nil {
+			t.Errorf("%s: Encode: %v", name, err)
+			continue
+		}
+
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: Decode: %v", name, err)
+			continue
+		}
+		gotNRGBA, ok := got.(*image.NRGBA)
+		if !ok {
+			t.Errorf("%s: decoded image is %T, want *image.NRGBA", name, got)
+			continue
+		}
+		if gotNRGBA.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds: got %v, want %v", name, gotNRGBA.Bounds(), want.Bounds())
+			continue
+		}
+		if !bytes.Equal(gotNRGBA.Pix, want.Pix) {
+			t.Errorf("%s: round-tripped pixels do not match", name)
+		}
+	}
+}
+
+// TestEncodeDecodeExplicitTransforms round-trips a gradient image (which
+// gives TransformColor real cross-channel correlation to fit coefficients
+// against) through each transform Options.Transforms can name individually,
+// checking that every one of them, not just the defaults
+// chooseDefaultTransforms picks, produces a bitstream Decode can read back
+// exactly.
+func TestEncodeDecodeExplicitTransforms(t *testing.T) {
+	b := image.Rect(0, 0, 32, 24)
+	src := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(2 * x),
+				G: uint8(4 * x),
+				B: uint8(x + 3*y),
+				A: 255,
+			})
+		}
+	}
+	want := toNRGBA(src)
+
+	for _, transform := range []Transform{TransformPredictor, TransformColor} {
+		var buf bytes.Buffer
+		o := &Options{Transforms: []Transform{transform}}
+		if err := Encode(&buf, want, o); err != nil {
+			t.Errorf("transform %v: Encode: %v", transform, err)
+			continue
+		}
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("transform %v: Decode: %v", transform, err)
+			continue
+		}
+		gotNRGBA, ok := got.(*image.NRGBA)
+		if !ok {
+			t.Errorf("transform %v: decoded image is %T, want *image.NRGBA", transform, got)
+			continue
+		}
+		if gotNRGBA.Bounds() != want.Bounds() || !bytes.Equal(gotNRGBA.Pix, want.Pix) {
+			t.Errorf("transform %v: round-tripped pixels do not match", transform)
+		}
+	}
+}
+
+// TestBuildHuffmanCodeLengthLimit builds a code over a Fibonacci-weighted
+// histogram, the classic worst case that drives a plain two-smallest-merge
+// Huffman tree to its maximum possible depth (one less than the symbol
+// count). With enough symbols that depth exceeds what VP8L's Huffman reader
+// accepts, so buildHuffmanCode must fall back to a flat code instead of
+// producing one Decode would reject.
+func TestBuildHuffmanCodeLengthLimit(t *testing.T) {
+	hist := make([]int, 18)
+	a, b := 1, 1
+	for i := range hist {
+		hist[i] = a
+		a, b = b, a+b
+	}
+
+	hc := buildHuffmanCode(hist)
+	for sym, l := range hc.lengths {
+		if l > maxHuffmanCodeLength {
+			t.Fatalf("symbol %d: code length %d exceeds the %d-bit limit", sym, l, maxHuffmanCodeLength)
+		}
+	}
+
+	bw := newBitWriter()
+	writeHuffmanCodeLengths(bw, hc.lengths)
+	br := newBitReader(bytes.NewReader(bw.bytes()))
+	tree, err := readHuffmanTree(br, len(hist))
+	if err != nil {
+		t.Fatalf("readHuffmanTree: %v", err)
+	}
+	for sym, l := range hc.lengths {
+		if l == 0 {
+			continue
+		}
+		var found bool
+		for _, e := range tree.entries {
+			if e.symbol == sym {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("symbol %d: missing from the decoded tree", sym)
+		}
+	}
+}
+
+func toNRGBA(m image.Image) *image.NRGBA {
+	if n, ok := m.(*image.NRGBA); ok {
+		return n
+	}
+	b := m.Bounds()
+	n := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			n.Set(x, y, m.At(x, y))
+		}
+	}
+	return n
+}
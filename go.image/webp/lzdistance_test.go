@@ -0,0 +1,37 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import "testing"
+
+// TestDistanceToPlaneCodeRoundTrip exercises distanceToPlaneCode and
+// planeCodeToDistance together: encoding a distance and decoding the result
+// must reproduce the original distance, the property writeImageData and
+// decodeARGBPlane rely on for every LZ77 back-reference.
+func TestDistanceToPlaneCodeRoundTrip(t *testing.T) {
+	widths := []int{1, 2, 3, 4, 7, 16, 100, 1920}
+	for _, width := range widths {
+		for dist := 1; dist <= 2000; dist++ {
+			code := distanceToPlaneCode(width, dist)
+			got := planeCodeToDistance(width, code)
+			if got != dist {
+				t.Errorf("width %d, distance %d: code %d decodes back to %d", width, dist, code, got)
+			}
+		}
+	}
+}
+
+// TestPlaneCodeToDistanceSmallOffsets checks a handful of the VP8L spec's
+// plane codes against their documented (dx,dy) meaning: code 1 is one row
+// up, and code 2 is one pixel to the left.
+func TestPlaneCodeToDistanceSmallOffsets(t *testing.T) {
+	const width = 100
+	if got, want := planeCodeToDistance(width, 1), width; got != want {
+		t.Errorf("plane code 1 (one row up): got distance %d, want %d", got, want)
+	}
+	if got, want := planeCodeToDistance(width, 2), 1; got != want {
+		t.Errorf("plane code 2 (one pixel left): got distance %d, want %d", got, want)
+	}
+}
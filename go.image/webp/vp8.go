@@ -0,0 +1,25 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// errVP8Unsupported is returned by decodeVP8 for every input: this package
+// decodes the lossless (VP8L) bitstream in full, but not yet the lossy
+// (VP8) bitstream, which needs a boolean entropy decoder, DCT/IDCT,
+// quantization tables and an in-loop deblocking filter that haven't been
+// ported yet.
+var errVP8Unsupported = errors.New("webp: lossy (VP8) bitstream decoding is not implemented")
+
+// decodeVP8 would decode r as a lossy VP8 bitstream into a *image.YCbCr.
+// It always returns errVP8Unsupported; callers that only need lossless
+// (VP8L) WebP files are unaffected.
+func decodeVP8(r io.Reader) (image.Image, error) {
+	return nil, errVP8Unsupported
+}
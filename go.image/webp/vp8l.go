@@ -0,0 +1,364 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Decode decodes r as a WebP image. Lossless (VP8L) files, including those
+// wrapped in a VP8X container, decode to an *image.NRGBA (or *image.NYCbCrA
+// if the container carries a separate alpha plane over a lossy bitmap);
+// lossy (VP8) files are not yet supported, see decodeVP8.
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := decodeTopLevel(r)
+	return img, err
+}
+
+// DecodeConfig returns the color model and dimensions of a WebP image
+// without decoding the pixel data.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	br := bufio.NewReader(r)
+	if _, err := readRIFFHeader(br); err != nil {
+		return image.Config{}, err
+	}
+	fourCC, length, err := readChunkHeader(br)
+	if err != nil {
+		return image.Config{}, err
+	}
+	switch fourCC {
+	case "VP8X":
+		if length < 10 {
+			return image.Config{}, errors.New("webp: invalid VP8X chunk")
+		}
+		var hdr [10]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return image.Config{}, err
+		}
+		w := 1 + (int(hdr[4]) | int(hdr[5])<<8 | int(hdr[6])<<16)
+		h := 1 + (int(hdr[7]) | int(hdr[8])<<8 | int(hdr[9])<<16)
+		if err := validateCanvasDimensions(w, h); err != nil {
+			return image.Config{}, err
+		}
+		return image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h}, nil
+	case "VP8L":
+		return decodeVP8LConfig(io.LimitReader(br, int64(length)))
+	case "VP8 ":
+		return image.Config{}, errVP8Unsupported
+	}
+	return image.Config{}, fmt.Errorf("webp: unknown chunk %q", fourCC)
+}
+
+// decodeVP8LConfig reads just enough of a VP8L chunk to report its
+// dimensions.
+func decodeVP8LConfig(r io.Reader) (image.Config, error) {
+	br := newBitReader(r)
+	if sig := br.readBits(8); sig != 0x2f {
+		return image.Config{}, errors.New("webp: invalid VP8L signature")
+	}
+	w := int(br.readBits(14)) + 1
+	h := int(br.readBits(14)) + 1
+	if br.err != nil {
+		return image.Config{}, br.err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h}, nil
+}
+
+// vp8lTransform is one transform read from a VP8L bitstream, along with
+// whatever auxiliary data (predictor modes, color-transform tiles, or a
+// palette) it carries. Transforms must be inverted in the reverse of the
+// order they were read, mirroring how Encode applies them.
+type vp8lTransform struct {
+	kind       int
+	blockBits  int
+	bw, bh     int
+	auxPix     []uint32 // predictor modes or color-transform tiles, one per tile
+	palette    []uint32 // color-indexing only
+}
+
+// decodeVP8L decodes the body of a VP8L chunk (everything after the fourCC
+// and length) into an ARGB pixel stream, inverts whatever transforms the
+// bitstream specifies, and returns the result as an *image.NRGBA.
+func decodeVP8L(r io.Reader) (image.Image, error) {
+	br := newBitReader(r)
+	if sig := br.readBits(8); sig != 0x2f {
+		return nil, errors.New("webp: invalid VP8L signature")
+	}
+	w := int(br.readBits(14)) + 1
+	h := int(br.readBits(14)) + 1
+	br.readBits(1) // alpha-is-used hint; decode doesn't need it
+	br.readBits(3) // version
+
+	var transforms []vp8lTransform
+	for br.readBits(1) == 1 {
+		if br.err != nil {
+			return nil, br.err
+		}
+		kind := int(br.readBits(2))
+		t := vp8lTransform{kind: kind}
+		switch kind {
+		case 0, 1: // predictor, color
+			t.blockBits = int(br.readBits(3))
+			blockSize := 1 << uint(t.blockBits+2)
+			t.bw = (w + blockSize - 1) / blockSize
+			t.bh = (h + blockSize - 1) / blockSize
+			aux, err := decodeARGBPlane(br, t.bw*t.bh, 0, t.bw)
+			if err != nil {
+				return nil, err
+			}
+			t.auxPix = aux
+		case 2: // subtract-green: no parameters
+		case 3: // color-indexing
+			palSize := int(br.readBits(8)) + 1
+			palDeltas, err := decodeARGBPlane(br, palSize, 0, palSize)
+			if err != nil {
+				return nil, err
+			}
+			pal := make([]uint32, palSize)
+			var prev uint32
+			for i, d := range palDeltas {
+				pal[i] = addARGB(d, prev)
+				prev = pal[i]
+			}
+			t.palette = pal
+		default:
+			return nil, errors.New("webp: invalid VP8L transform type")
+		}
+		transforms = append(transforms, t)
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+
+	cacheBits := 0
+	if br.readBits(1) == 1 {
+		cacheBits = int(br.readBits(4))
+	}
+	if br.readBits(1) != 0 {
+		return nil, errors.New("webp: unsupported meta-Huffman image in VP8L data")
+	}
+
+	pix, err := decodeARGBPlane(br, w*h, cacheBits, w)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(transforms) - 1; i >= 0; i-- {
+		t := transforms[i]
+		switch t.kind {
+		case 0:
+			invPredictorTransform(pix, w, h, t.auxPix, t.bw, 1<<uint(t.blockBits+2))
+		case 1:
+			invColorTransform(pix, w, h, t.auxPix, t.bw, 1<<uint(t.blockBits+2))
+		case 2:
+			invSubtractGreenTransform(pix)
+		case 3:
+			pix, err = invColorIndexing(pix, t.palette)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return argbToNRGBA(pix, w, h), nil
+}
+
+// decodeARGBPlane decodes n ARGB pixels, from a plane of the given width,
+// entropy-coded the way writeImageData writes them: five Huffman trees
+// (green+length+cache, red, blue, alpha, distance) followed by the LZ77 +
+// color-cache token stream.
+func decodeARGBPlane(br *bitReader, n, cacheBits, width int) ([]uint32, error) {
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << uint(cacheBits)
+	}
+	greenLenAlphabet := 256 + 24 + cacheSize
+
+	greenTree, err := readHuffmanTree(br, greenLenAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	redTree, err := readHuffmanTree(br, 256)
+	if err != nil {
+		return nil, err
+	}
+	blueTree, err := readHuffmanTree(br, 256)
+	if err != nil {
+		return nil, err
+	}
+	alphaTree, err := readHuffmanTree(br, 256)
+	if err != nil {
+		return nil, err
+	}
+	distTree, err := readHuffmanTree(br, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]uint32, n)
+	var cache []uint32
+	if cacheSize > 0 {
+		cache = make([]uint32, cacheSize)
+	}
+	cacheIndex := func(p uint32) int {
+		return int((p * 0x1e35a7bd) >> uint(32-cacheBits))
+	}
+
+	i := 0
+	for i < n {
+		sym := greenTree.read(br)
+		switch {
+		case sym < 256:
+			r := redTree.read(br)
+			bl := blueTree.read(br)
+			a := alphaTree.read(br)
+			p := uint32(a)<<24 | uint32(r)<<16 | uint32(sym)<<8 | uint32(bl)
+			out[i] = p
+			if cache != nil {
+				cache[cacheIndex(p)] = p
+			}
+			i++
+		case sym < 256+24:
+			length := decodeRangeValue(br, sym-256) + 1
+			distSym := distTree.read(br)
+			planeCode := decodeRangeValue(br, distSym) + 1
+			distance := planeCodeToDistance(width, planeCode)
+			if distance > i {
+				return nil, errors.New("webp: invalid back-reference in VP8L data")
+			}
+			for k := 0; k < length && i < n; k++ {
+				p := out[i-distance]
+				out[i] = p
+				if cache != nil {
+					cache[cacheIndex(p)] = p
+				}
+				i++
+			}
+		default:
+			idx := sym - 256 - 24
+			if cache == nil || idx >= len(cache) {
+				return nil, errors.New("webp: invalid color-cache symbol in VP8L data")
+			}
+			out[i] = cache[idx]
+			i++
+		}
+		if br.err != nil {
+			return nil, br.err
+		}
+	}
+	return out, nil
+}
+
+// addARGB is the inverse of subARGB: per-channel addition mod 256.
+func addARGB(p, pred uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := (p >> shift) & 0xff
+		pv := (pred >> shift) & 0xff
+		out |= ((v + pv) & 0xff) << shift
+	}
+	return out
+}
+
+// invSubtractGreenTransform is the inverse of subtractGreenTransform.
+func invSubtractGreenTransform(pix []uint32) {
+	for i, p := range pix {
+		a := p >> 24
+		r := (p >> 16) & 0xff
+		g := (p >> 8) & 0xff
+		b := p & 0xff
+		r = (r + g) & 0xff
+		b = (b + g) & 0xff
+		pix[i] = a<<24 | r<<16 | g<<8 | b
+	}
+}
+
+// invPredictorTransform is the inverse of predictorTransform: it must walk
+// pixels in increasing order so that, by the time pixel i is reconstructed,
+// the neighbors its predictor reads from have already been restored to
+// their original values.
+func invPredictorTransform(pix []uint32, w, h int, modes []uint32, bw, blockSize int) {
+	modeAt := func(x, y int) uint32 {
+		return (modes[(y/blockSize)*bw+(x/blockSize)] >> 8) & 0xff
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			var pred uint32 = 0xff000000
+			switch modeAt(x, y) {
+			case 0:
+				pred = 0xff000000
+			default:
+				// Mode 1: predict from the left, falling back to the
+				// pixel above for the first column, matching the
+				// (mode-independent) border rules predictorTransform
+				// applies.
+				if x > 0 {
+					pred = pix[i-1]
+				} else if y > 0 {
+					pred = pix[i-w]
+				}
+			}
+			pix[i] = addARGB(pix[i], pred)
+		}
+	}
+}
+
+// colorTransformDelta implements the VP8L color transform's
+// ColorTransformDelta(t, c) = (t*c) >> 5 over signed bytes.
+func colorTransformDelta(t, c uint8) uint8 {
+	return uint8((int32(int8(t)) * int32(int8(c))) >> 5)
+}
+
+// invColorTransform is the inverse of colorTransformForward.
+func invColorTransform(pix []uint32, w, h int, tiles []uint32, bw, blockSize int) {
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			tile := tiles[(y/blockSize)*bw+(x/blockSize)]
+			g2r := uint8(tile >> 16)
+			g2b := uint8(tile >> 8)
+			r2b := uint8(tile)
+			a := pix[i] >> 24
+			r := uint8(pix[i] >> 16)
+			g := uint8(pix[i] >> 8)
+			b := uint8(pix[i])
+			b += colorTransformDelta(r2b, r)
+			b += colorTransformDelta(g2b, g)
+			r += colorTransformDelta(g2r, g)
+			pix[i] = a<<24 | uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+		}
+	}
+}
+
+// invColorIndexing is the inverse of applyColorIndexing: each pixel's green
+// channel holds a palette index.
+func invColorIndexing(pix []uint32, pal []uint32) ([]uint32, error) {
+	out := make([]uint32, len(pix))
+	for i, p := range pix {
+		idx := (p >> 8) & 0xff
+		if int(idx) >= len(pal) {
+			return nil, errors.New("webp: palette index out of range")
+		}
+		out[i] = pal[idx]
+	}
+	return out, nil
+}
+
+func argbToNRGBA(pix []uint32, w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i, p := range pix {
+		img.Pix[i*4+0] = byte(p >> 16)
+		img.Pix[i*4+1] = byte(p >> 8)
+		img.Pix[i*4+2] = byte(p)
+		img.Pix[i*4+3] = byte(p >> 24)
+	}
+	return img
+}
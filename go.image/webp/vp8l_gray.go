@@ -0,0 +1,300 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"errors"
+	"io"
+)
+
+// decodeVP8LGray decodes the single-channel (green-only) VP8L bitstream
+// used to losslessly compress an ALPH chunk, returning w*h bytes in
+// row-major order. Unlike a full VP8L image, the alpha bitstream has no
+// red/blue/alpha Huffman trees and no subtract-green or color-indexing
+// transforms; at most a predictor transform may be present.
+func decodeVP8LGray(r io.Reader, w, h int) ([]byte, error) {
+	br := newBitReader(r)
+
+	usePredictor := false
+	var predBlockBits int
+	if br.readBits(1) == 1 {
+		transformType := br.readBits(2)
+		if transformType != 0 {
+			return nil, errors.New("webp: unsupported transform in ALPH lossless data")
+		}
+		usePredictor = true
+		predBlockBits = int(br.readBits(3))
+		if br.readBits(1) != 0 {
+			return nil, errors.New("webp: unsupported transform in ALPH lossless data")
+		}
+	}
+
+	cacheBits := 0
+	if br.readBits(1) == 1 {
+		cacheBits = int(br.readBits(4))
+	}
+	if br.readBits(1) != 0 {
+		return nil, errors.New("webp: unsupported meta-Huffman image in ALPH lossless data")
+	}
+
+	pix, err := decodeTokenPlane(br, w*h, cacheBits, w)
+	if err != nil {
+		return nil, err
+	}
+	if br.err != nil && br.err != io.EOF {
+		return nil, br.err
+	}
+
+	if usePredictor {
+		blockSize := 1 << uint(predBlockBits+2)
+		bw := (w + blockSize - 1) / blockSize
+		bh := (h + blockSize - 1) / blockSize
+		modes, err := decodeTokenPlane(br, bw*bh, 0, bw)
+		if err != nil {
+			return nil, err
+		}
+		unpredictGray(pix, w, h, modes, bw, blockSize)
+	}
+
+	return pix, nil
+}
+
+// decodeTokenPlane decodes a single-channel Huffman+LZ77(+cache) coded
+// plane of exactly n bytes, from a plane of the given width: one Huffman
+// tree over the literal/length/cache alphabet, and one over the distance
+// alphabet.
+func decodeTokenPlane(br *bitReader, n, cacheBits, width int) ([]byte, error) {
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << uint(cacheBits)
+	}
+	litAlphabet := 256 + 24 + cacheSize
+
+	litTree, err := readHuffmanTree(br, litAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	distTree, err := readHuffmanTree(br, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, n)
+	var cache []byte
+	if cacheSize > 0 {
+		cache = make([]byte, cacheSize)
+	}
+	cacheIndex := func(v byte) int {
+		return int((uint32(v) * 0x1e35a7bd) >> uint(32-cacheBits))
+	}
+
+	i := 0
+	for i < n {
+		sym := litTree.read(br)
+		switch {
+		case sym < 256:
+			out[i] = byte(sym)
+			if cache != nil {
+				cache[cacheIndex(byte(sym))] = byte(sym)
+			}
+			i++
+		case sym < 256+24:
+			length := decodeRangeValue(br, sym-256) + 1
+			distSym := distTree.read(br)
+			planeCode := decodeRangeValue(br, distSym) + 1
+			distance := planeCodeToDistance(width, planeCode)
+			if distance > i || length <= 0 {
+				return nil, errors.New("webp: invalid back-reference in ALPH lossless data")
+			}
+			for k := 0; k < length && i < n; k++ {
+				out[i] = out[i-distance]
+				if cache != nil {
+					cache[cacheIndex(out[i])] = out[i]
+				}
+				i++
+			}
+		default:
+			idx := sym - 256 - 24
+			if cache == nil || idx >= len(cache) {
+				return nil, errors.New("webp: invalid color-cache symbol in ALPH lossless data")
+			}
+			out[i] = cache[idx]
+			i++
+		}
+		if br.err != nil {
+			return nil, br.err
+		}
+	}
+	return out, nil
+}
+
+// decodeRangeValue is the inverse of rangeCodeAndExtra: given a code, it
+// reads any extra bits from br and returns the encoded value.
+func decodeRangeValue(br *bitReader, code int) int {
+	if code < 4 {
+		return code
+	}
+	nbits := uint(code/2 - 1)
+	base := 1 << (nbits + 1)
+	extra := int(br.readBits(nbits))
+	if code%2 == 0 {
+		return base + extra
+	}
+	return base + (1 << nbits) + extra
+}
+
+// unpredictGray reverses a predictor transform over a single-channel plane,
+// using the same predictor numbering as the main ARGB predictor transform,
+// restricted to the handful of predictors that make sense for one channel.
+func unpredictGray(pix []byte, w, h int, modes []byte, bw, blockSize int) {
+	modeAt := func(x, y int) byte {
+		return modes[(y/blockSize)*bw+(x/blockSize)]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			var left, top byte
+			if x > 0 {
+				left = pix[i-1]
+			}
+			if y > 0 {
+				top = pix[i-w]
+			}
+			var pred byte
+			switch modeAt(x, y) {
+			case 0:
+				pred = 0
+			case 1:
+				pred = left
+			case 2:
+				pred = top
+			default:
+				pred = gradientPredict(left, top, 0)
+			}
+			pix[i] += pred
+		}
+	}
+}
+
+// --- bit reader --------------------------------------------------------
+
+// bitReader unpacks bits LSB-first within each byte, the mirror image of
+// bitWriter.
+type bitReader struct {
+	r      io.Reader
+	bitBuf uint64
+	nBits  uint
+	err    error
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{r: r}
+}
+
+func (b *bitReader) readBits(n uint) uint32 {
+	for b.nBits < n && b.err == nil {
+		var buf [1]byte
+		if _, err := io.ReadFull(b.r, buf[:]); err != nil {
+			b.err = err
+			break
+		}
+		b.bitBuf |= uint64(buf[0]) << b.nBits
+		b.nBits += 8
+	}
+	v := uint32(b.bitBuf & ((1 << n) - 1))
+	b.bitBuf >>= n
+	if n <= b.nBits {
+		b.nBits -= n
+	} else {
+		b.nBits = 0
+	}
+	return v
+}
+
+// --- Huffman decode tree -------------------------------------------------
+
+type huffmanTree struct {
+	// symbolOf[length][code] is unused; instead we use a simple sorted
+	// table of (length, code, symbol) since these alphabets are small.
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	length uint8
+	code   uint32
+	symbol int
+}
+
+// read walks br bit by bit (MSB-first, as Huffman codes are conventionally
+// written) until it matches one of t's codes.
+func (t *huffmanTree) read(br *bitReader) int {
+	var code uint32
+	var length uint8
+	for {
+		code = (code << 1) | br.readBits(1)
+		length++
+		for _, e := range t.entries {
+			if e.length == length && e.code == code {
+				return e.symbol
+			}
+		}
+		if length > 15 || br.err != nil {
+			br.err = errors.New("webp: invalid Huffman code")
+			return 0
+		}
+	}
+}
+
+// readHuffmanTree reads a Huffman code description in the VP8L
+// "simple"/"normal" code-length-code format and builds the decode table for
+// an alphabet of size n.
+func readHuffmanTree(br *bitReader, n int) (*huffmanTree, error) {
+	lengths := make([]uint8, n)
+	if br.readBits(1) == 1 {
+		// Simple code length code: at most one symbol.
+		if br.readBits(1) == 0 {
+			sym := int(br.readBits(8))
+			if sym < n {
+				lengths[sym] = 1
+			}
+		}
+		return buildHuffmanTree(lengths), br.err
+	}
+
+	order := [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	numCodes := int(br.readBits(4)) + 4
+	clLengths := make([]uint8, 19)
+	for i := 0; i < numCodes; i++ {
+		clLengths[order[i]] = uint8(br.readBits(3))
+	}
+	clTree := buildHuffmanTree(clLengths)
+	if br.readBits(1) != 0 {
+		return nil, errors.New("webp: unsupported max_symbol optimization")
+	}
+	for i := 0; i < n; i++ {
+		lengths[i] = uint8(clTree.read(br))
+		if br.err != nil {
+			return nil, br.err
+		}
+	}
+	return buildHuffmanTree(lengths), br.err
+}
+
+func buildHuffmanTree(lengths []uint8) *huffmanTree {
+	hc := finishHuffman(lengths)
+	t := &huffmanTree{}
+	for sym, l := range hc.lengths {
+		if l == 0 {
+			continue
+		}
+		// hc.codes[sym] is already MSB-first, the same convention
+		// huffmanTree.read accumulates incoming bits in; no bit
+		// reversal is needed here (writeBitsMSBFirst does that
+		// reversal on the writer side, once, when it turns the code
+		// into an LSB-first bit sequence to physically write).
+		t.entries = append(t.entries, huffmanEntry{length: l, code: hc.codes[sym], symbol: sym})
+	}
+	return t
+}
@@ -0,0 +1,364 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Metadata holds the auxiliary, non-pixel chunks that may accompany an
+// extended (VP8X) WebP file.
+type Metadata struct {
+	// ICCP is the raw ICC color profile, or nil if the file had none.
+	ICCP []byte
+	// EXIF is the raw Exif metadata blob, or nil if the file had none.
+	EXIF []byte
+	// XMP is the raw XMP metadata blob, or nil if the file had none.
+	XMP []byte
+}
+
+// vp8xFeatures are the flag bits stored in a VP8X chunk, in the order they
+// appear (MSB first) in the flags byte.
+type vp8xFeatures struct {
+	hasICC   bool
+	hasAlpha bool
+	hasExif  bool
+	hasXMP   bool
+	hasAnim  bool
+}
+
+func readVP8XFeatures(flags byte) vp8xFeatures {
+	return vp8xFeatures{
+		hasICC:   flags&(1<<5) != 0,
+		hasAlpha: flags&(1<<4) != 0,
+		hasExif:  flags&(1<<3) != 0,
+		hasXMP:   flags&(1<<2) != 0,
+		hasAnim:  flags&(1<<1) != 0,
+	}
+}
+
+// readRIFFHeader reads and validates the "RIFF"<size>"WEBP" preamble common
+// to every WebP file, returning the number of payload bytes that follow.
+func readRIFFHeader(r io.Reader) (payloadLen uint32, err error) {
+	var b [12]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	if string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return 0, errors.New("webp: invalid format")
+	}
+	riffLen := uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24
+	if riffLen < 4 {
+		return 0, errors.New("webp: invalid format")
+	}
+	return riffLen - 4, nil
+}
+
+// readChunkHeader reads a fourCC and its chunk length. Per RIFF, chunks are
+// padded to an even length; the returned length is the unpadded payload
+// size.
+func readChunkHeader(r *bufio.Reader) (fourCC string, length uint32, err error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", 0, err
+	}
+	fourCC = string(b[0:4])
+	length = uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24
+	return fourCC, length, nil
+}
+
+// skipChunkPadding discards the single padding byte RIFF appends after an
+// odd-length chunk.
+func skipChunkPadding(r *bufio.Reader, length uint32) error {
+	if length%2 == 1 {
+		if _, err := r.Discard(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBoundedChunk decodes a chunk's length-bounded body with decode, then
+// discards whatever bytes of that length decode left unread. A VP8L payload
+// commonly carries a trailing pad byte decode never needs to consume, and
+// without this the next sibling chunk header would be misread starting
+// partway through it.
+func readBoundedChunk(r *bufio.Reader, length uint32, decode func(io.Reader) (image.Image, error)) (image.Image, error) {
+	lr := &io.LimitedReader{R: r, N: int64(length)}
+	m, err := decode(lr)
+	if err != nil {
+		return nil, err
+	}
+	if lr.N > 0 {
+		if _, err := io.CopyN(io.Discard, lr.R, lr.N); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// DecodeMetadata decodes r as a WebP image, as Decode does, but additionally
+// returns any ICCP, EXIF, and XMP chunks present. Metadata is the zero value
+// for simple (non-VP8X) files.
+func DecodeMetadata(r io.Reader) (image.Image, Metadata, error) {
+	return decodeTopLevel(r)
+}
+
+// decodeTopLevel parses the RIFF/WebP preamble and dispatches on the first
+// chunk, shared by Decode and DecodeMetadata.
+func decodeTopLevel(r io.Reader) (image.Image, Metadata, error) {
+	br := bufio.NewReader(r)
+	payloadLen, err := readRIFFHeader(br)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	fourCC, length, err := readChunkHeader(br)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	payloadLen -= 8
+
+	switch fourCC {
+	case "VP8 ":
+		m, err := readBoundedChunk(br, length, decodeVP8)
+		return m, Metadata{}, err
+	case "VP8L":
+		m, err := readBoundedChunk(br, length, decodeVP8L)
+		return m, Metadata{}, err
+	case "VP8X":
+		return decodeVP8X(br, length, payloadLen)
+	}
+	return nil, Metadata{}, fmt.Errorf("webp: unknown chunk %q", fourCC)
+}
+
+// maxCanvasDimension is the largest width or height this package accepts
+// from a VP8X header's 24-bit canvas fields. VP8X's own encoding permits
+// values up to 2^24, far beyond any real WebP canvas (the format's actual
+// limit is 16384 per side); without a bound here, a few crafted header
+// bytes could otherwise demand a multi-terabyte allocation before a single
+// further byte of the file has even been validated.
+const maxCanvasDimension = 1 << 14
+
+func validateCanvasDimensions(width, height int) error {
+	if width > maxCanvasDimension || height > maxCanvasDimension {
+		return fmt.Errorf("webp: canvas dimensions %dx%d exceed the %d-pixel limit", width, height, maxCanvasDimension)
+	}
+	return nil
+}
+
+// decodeVP8X decodes the body of a VP8X container: the feature/canvas
+// header, plus the ICCP, ALPH, VP8/VP8L, EXIF and XMP chunks that may
+// follow it in any order.
+func decodeVP8X(br *bufio.Reader, vp8xLen, remaining uint32) (image.Image, Metadata, error) {
+	if vp8xLen < 10 {
+		return nil, Metadata{}, errors.New("webp: invalid VP8X chunk")
+	}
+	var hdr [10]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, Metadata{}, err
+	}
+	if err := skipChunkPadding(br, vp8xLen); err != nil {
+		return nil, Metadata{}, err
+	}
+	features := readVP8XFeatures(hdr[0])
+	width := 1 + (int(hdr[4]) | int(hdr[5])<<8 | int(hdr[6])<<16)
+	height := 1 + (int(hdr[7]) | int(hdr[8])<<8 | int(hdr[9])<<16)
+	if err := validateCanvasDimensions(width, height); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var (
+		meta      Metadata
+		img       image.Image
+		alpha     []byte
+		sawBitmap bool
+	)
+
+	for {
+		fourCC, length, err := readChunkHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		switch fourCC {
+		case "ICCP":
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return nil, Metadata{}, err
+			}
+			meta.ICCP = buf
+		case "EXIF":
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return nil, Metadata{}, err
+			}
+			meta.EXIF = buf
+		case "XMP ":
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return nil, Metadata{}, err
+			}
+			meta.XMP = buf
+		case "ALPH":
+			lr := &io.LimitedReader{R: br, N: int64(length)}
+			a, err := decodeALPH(lr, width, height)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+			if lr.N > 0 {
+				if _, err := io.CopyN(io.Discard, lr.R, lr.N); err != nil {
+					return nil, Metadata{}, err
+				}
+			}
+			alpha = a
+		case "VP8 ":
+			m, err := readBoundedChunk(br, length, decodeVP8)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+			img, sawBitmap = m, true
+		case "VP8L":
+			m, err := readBoundedChunk(br, length, decodeVP8L)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+			img, sawBitmap = m, true
+		default:
+			if _, err := br.Discard(int(length)); err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+		if err := skipChunkPadding(br, length); err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	if !sawBitmap {
+		return nil, Metadata{}, errors.New("webp: VP8X file has no image data")
+	}
+	if features.hasAlpha && alpha != nil {
+		if yc, ok := img.(*image.YCbCr); ok {
+			img = combineYCbCrAlpha(yc, alpha)
+		}
+	}
+	return img, meta, nil
+}
+
+// combineYCbCrAlpha attaches an 8-bit alpha plane (one byte per pixel, row
+// major, matching yc's bounds) to a lossy VP8 image, yielding the
+// *image.NYCbCrA that lossy+alpha WebP files decode to.
+func combineYCbCrAlpha(yc *image.YCbCr, alpha []byte) *image.NYCbCrA {
+	b := yc.Bounds()
+	return &image.NYCbCrA{
+		YCbCr:   *yc,
+		A:       alpha,
+		AStride: b.Dx(),
+	}
+}
+
+// alphaFilter identifies the ALPH chunk's pre-filtering method, which must
+// be undone after decompressing the alpha plane.
+type alphaFilter int
+
+const (
+	alphaFilterNone alphaFilter = iota
+	alphaFilterHorizontal
+	alphaFilterVertical
+	alphaFilterGradient
+)
+
+// decodeALPH decodes an ALPH chunk into a w*h byte slice of unfiltered alpha
+// values, one byte per pixel in row-major order.
+func decodeALPH(r io.Reader, w, h int) ([]byte, error) {
+	var hdr [1]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	compression := hdr[0] & 0x03
+	filter := alphaFilter((hdr[0] >> 2) & 0x03)
+
+	var raw []byte
+	switch compression {
+	case 0: // no compression
+		raw = make([]byte, w*h)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+	case 1: // VP8L-compressed, single (green) channel
+		a, err := decodeVP8LGray(r, w, h)
+		if err != nil {
+			return nil, err
+		}
+		raw = a
+	default:
+		return nil, errors.New("webp: invalid ALPH compression method")
+	}
+
+	unfilterAlpha(raw, w, h, filter)
+	return raw, nil
+}
+
+// unfilterAlpha reverses the ALPH chunk's row/column prediction filter
+// in place.
+func unfilterAlpha(a []byte, w, h int, f alphaFilter) {
+	switch f {
+	case alphaFilterNone:
+		return
+	case alphaFilterHorizontal:
+		for y := 0; y < h; y++ {
+			row := a[y*w : y*w+w]
+			if y > 0 && w > 0 {
+				row[0] += a[(y-1)*w]
+			}
+			for x := 1; x < w; x++ {
+				row[x] += row[x-1]
+			}
+		}
+	case alphaFilterVertical:
+		for y := 1; y < h; y++ {
+			for x := 0; x < w; x++ {
+				a[y*w+x] += a[(y-1)*w+x]
+			}
+		}
+		for x := 1; x < w && h > 0; x++ {
+			a[x] += a[x-1]
+		}
+	case alphaFilterGradient:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var left, top, topLeft byte
+				if x > 0 {
+					left = a[y*w+x-1]
+				}
+				if y > 0 {
+					top = a[(y-1)*w+x]
+				}
+				if x > 0 && y > 0 {
+					topLeft = a[(y-1)*w+x-1]
+				}
+				pred := gradientPredict(left, top, topLeft)
+				a[y*w+x] += pred
+			}
+		}
+	}
+}
+
+func gradientPredict(left, top, topLeft byte) byte {
+	v := int(left) + int(top) - int(topLeft)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// buildVP8X assembles a minimal VP8X WebP file around a VP8L bitmap, with
+// optional ICCP/EXIF/XMP chunks. There's no lossy+alpha fixture here since
+// decodeVP8 doesn't support lossy bitstreams yet; VP8L exercises the same
+// VP8X framing and chunk dispatch this package actually implements.
+func buildVP8X(t *testing.T, img image.Image, iccp, exif, xmp []byte) []byte {
+	t.Helper()
+	payload, _, err := encodeVP8L(img, &Options{})
+	if err != nil {
+		t.Fatalf("encodeVP8L: %v", err)
+	}
+	if len(payload)%2 != 0 {
+		payload = append(payload, 0)
+	}
+
+	var flags byte
+	if iccp != nil {
+		flags |= 1 << 5
+	}
+	if exif != nil {
+		flags |= 1 << 3
+	}
+	if xmp != nil {
+		flags |= 1 << 2
+	}
+
+	b := img.Bounds()
+	var vp8x bytes.Buffer
+	vp8x.WriteByte(flags)
+	vp8x.Write([]byte{0, 0, 0})
+	writeDim(&vp8x, b.Dx())
+	writeDim(&vp8x, b.Dy())
+
+	var body bytes.Buffer
+	writeRIFFChunk(&body, "VP8X", vp8x.Bytes())
+	if iccp != nil {
+		writeRIFFChunk(&body, "ICCP", iccp)
+	}
+	if exif != nil {
+		writeRIFFChunk(&body, "EXIF", exif)
+	}
+	if xmp != nil {
+		writeRIFFChunk(&body, "XMP ", xmp)
+	}
+	writeRIFFChunk(&body, "VP8L", payload)
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	writeLE32(&out, uint32(4+body.Len()))
+	out.WriteString("WEBP")
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func writeDim(buf *bytes.Buffer, n int) {
+	v := uint32(n - 1)
+	buf.WriteByte(byte(v))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v >> 16))
+}
+
+func writeLE32(buf *bytes.Buffer, v uint32) {
+	buf.WriteByte(byte(v))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v >> 16))
+	buf.WriteByte(byte(v >> 24))
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	writeLE32(buf, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func testImage() *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 40), G: uint8(y * 60), B: 200, A: 255})
+		}
+	}
+	return m
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	img := testImage()
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		wantICC  bool
+		wantExif bool
+		wantXMP  bool
+	}{
+		{"lossless", buildVP8X(t, img, nil, nil, nil), false, false, false},
+		{"metadata-only", buildVP8X(t, img, []byte("fake-icc-profile"), []byte("fake-exif"), []byte("<xmp/>")), true, true, true},
+	}
+
+	for _, tc := range testCases {
+		gotImg, meta, err := DecodeMetadata(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Errorf("%s: DecodeMetadata: %v", tc.name, err)
+			continue
+		}
+		if tc.wantICC && meta.ICCP == nil {
+			t.Errorf("%s: missing ICCP chunk", tc.name)
+		}
+		if tc.wantExif && meta.EXIF == nil {
+			t.Errorf("%s: missing EXIF chunk", tc.name)
+		}
+		if tc.wantXMP && meta.XMP == nil {
+			t.Errorf("%s: missing XMP chunk", tc.name)
+		}
+		got, ok := gotImg.(*image.NRGBA)
+		if !ok {
+			t.Errorf("%s: decoded image is %T, want *image.NRGBA", tc.name, gotImg)
+			continue
+		}
+		if got.Bounds() != img.Bounds() || !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%s: decoded pixels do not match the source image", tc.name)
+		}
+	}
+}
+
+// TestDecodeVP8XRejectsOversizedCanvas checks that a VP8X header claiming a
+// canvas far larger than any real WebP image (its 24-bit width/height
+// fields nominally allow up to 2^24) is rejected before decodeALPH or
+// decodeVP8X would otherwise size an allocation off of it.
+func TestDecodeVP8XRejectsOversizedCanvas(t *testing.T) {
+	var vp8x bytes.Buffer
+	vp8x.WriteByte(1 << 4) // hasAlpha flag
+	vp8x.Write([]byte{0, 0, 0})
+	writeDim24(&vp8x, 1<<23) // width-1: far beyond maxCanvasDimension
+	writeDim24(&vp8x, 1<<23) // height-1
+
+	var body bytes.Buffer
+	writeRIFFChunk(&body, "VP8X", vp8x.Bytes())
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	writeLE32(&out, uint32(4+body.Len()))
+	out.WriteString("WEBP")
+	out.Write(body.Bytes())
+
+	if _, err := Decode(bytes.NewReader(out.Bytes())); err == nil {
+		t.Fatal("Decode: got nil error for an oversized canvas, want an error")
+	}
+}
+
+// TestUnfilterAlphaHorizontal exercises unfilterAlpha's horizontal-filter
+// case directly: a top-row carry into column 0 must be applied before that
+// row's left-to-right accumulation, not after.
+func TestUnfilterAlphaHorizontal(t *testing.T) {
+	// Two rows, three columns. Row 0 unfiltered: 10, 12, 15 (deltas 10,2,3).
+	// Row 1 unfiltered: 20, 21, 19 (deltas 10,1,254, wrapping mod 256).
+	raw := []byte{10, 2, 3, 10, 1, 254}
+	unfilterAlpha(raw, 3, 2, alphaFilterHorizontal)
+	want := []byte{10, 12, 15, 20, 21, 19}
+	if !bytes.Equal(raw, want) {
+		t.Errorf("unfilterAlpha: got %v, want %v", raw, want)
+	}
+}